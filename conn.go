@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// bufSetter is implemented by the connection types whose socket buffer sizes
+// can be tuned directly (net.TCPConn, net.UDPConn and net.UnixConn all
+// satisfy it); it lets the generic handlers below size buffers without
+// caring which transport they were handed.
+type bufSetter interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// setBuffers sets c's receive/send buffer sizes; a size of 0 or less leaves
+// that buffer at the OS default.
+func setBuffers(c net.Conn, read, write int) {
+	if bs, ok := c.(bufSetter); ok {
+		if read > 0 {
+			bs.SetReadBuffer(read)
+		}
+		if write > 0 {
+			bs.SetWriteBuffer(write)
+		}
+	}
+}
+
+func isPacketProto(proto string) bool {
+	switch proto {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	}
+	return false
+}
+
+func isUnixProto(proto string) bool {
+	return proto == "unix" || proto == "unixgram"
+}
+
+// ListenAndGo listens on s.proto/s.addr and hands every client conn to
+// s.handler. Stream transports (tcp*, unix) go through Accept; connectionless
+// transports (udp*, unixgram) are demultiplexed in listenAndGoPacket.
+func (s *Server) ListenAndGo() error {
+	if isPacketProto(s.proto) {
+		return s.listenAndGoPacket()
+	}
+	return s.listenAndGoStream()
+}
+
+func (s *Server) listenAndGoStream() error {
+	ln, err := net.Listen(s.proto, s.addr)
+	if err != nil {
+		logger.Error("failed to listen for connections", "addr", s.addr, "err", err)
+		return err
+	}
+	go func() {
+		<-s.ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return nil
+			default:
+			}
+			logger.Error("failed to accept connection", "err", err)
+			continue
+		}
+		tuneConn(conn)
+		logger.Info("client connected", "remote_addr", conn.RemoteAddr())
+		runWG.Add(1)
+		go func() {
+			defer runWG.Done()
+			s.handler(conn)
+		}()
+	}
+	return nil
+}
+
+func resolveLocalAddr(proto, addr string) (net.Addr, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	switch proto {
+	case "tcp", "tcp4", "tcp6":
+		return net.ResolveTCPAddr(proto, addr)
+	case "udp", "udp4", "udp6":
+		return net.ResolveUDPAddr(proto, addr)
+	case "unix", "unixgram":
+		return net.ResolveUnixAddr(proto, addr)
+	}
+	return nil, fmt.Errorf("unsupported proto %s", proto)
+}
+
+func (c *Client) NewConnection() (net.Conn, error) {
+	laddr, err := resolveLocalAddr(c.proto, c.saddr)
+	if err != nil {
+		logger.Error("failed to resolve local address", "addr", c.saddr, "err", err)
+		return nil, err
+	}
+	d := net.Dialer{LocalAddr: laddr}
+	return d.Dial(c.proto, c.addr)
+}
+
+func (c *Client) ConnectAndGo() error {
+	conns := make([]net.Conn, c.concurrency)
+	for i := 0; i < c.concurrency; i++ {
+		conn, err := c.NewConnection()
+		if err != nil {
+			logger.Error("failed to connect to server", "addr", c.addr, "saddr", c.saddr, "err", err)
+			return err
+		}
+		tuneConn(conn)
+		logger.Info("client connected", "local_addr", conn.LocalAddr(), "remote_addr", conn.RemoteAddr())
+		conns[i] = conn
+	}
+	for i := 0; i < c.concurrency; i++ {
+		conn := conns[i]
+		runWG.Add(1)
+		go func() {
+			defer runWG.Done()
+			c.handler(conn)
+		}()
+	}
+	return nil
+}
+
+func ConnRead(c net.Conn) error {
+	stats := registerConn(c)
+	defer unregisterConn(c)
+
+	for {
+		n, err := c.Read(b)
+		if n > 0 {
+			stats.addIn(n)
+		}
+		if err != nil {
+			if err == io.EOF {
+				logger.Info("client disconnected", "remote_addr", c.RemoteAddr())
+				c.Close()
+				return nil
+			} else {
+				logger.Error("failed reading bytes from conn", "remote_addr", c.RemoteAddr(), "err", err)
+				c.Close()
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var b []byte
+
+func ConnWrite(c net.Conn) error {
+	stats := registerConn(c)
+	defer unregisterConn(c)
+
+	for {
+		n, err := c.Write(b)
+		if n > 0 {
+			stats.addOut(n)
+		}
+		if err != nil {
+			if err == io.EOF {
+				logger.Info("client disconnected", "remote_addr", c.RemoteAddr())
+				c.Close()
+				return nil
+			} else {
+				logger.Error("failed writing bytes to conn", "remote_addr", c.RemoteAddr(), "err", err)
+				c.Close()
+				return err
+			}
+		}
+	}
+	return nil
+}
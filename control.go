@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The control subsystem turns netperf from a single-pair benchmark into a
+// distributed load generator: one process runs as coordinator, N worker
+// processes register with it, and the coordinator hands out a synchronized
+// test plan for them all to run against a shared target. Messages are
+// exchanged as a 4-byte big-endian length prefix followed by a JSON payload
+// over a plain TCP connection.
+
+type workerHello struct {
+	ID       string `json:"id"`
+	Capacity int    `json:"capacity"`
+}
+
+// TestSpec describes the benchmark every worker should run against Target,
+// plus a synchronized start time. It's HMAC-signed by the coordinator so a
+// worker can tell the spec actually came from the coordinator it registered
+// with.
+type TestSpec struct {
+	Proto    string        `json:"proto"`
+	Target   string        `json:"target"`
+	Size     int           `json:"size"`
+	Nconn    int           `json:"nconn"`
+	Duration time.Duration `json:"duration"`
+	Reqres   bool          `json:"reqres"`
+	Nflight  int           `json:"nflight"`
+	StartAt  time.Time     `json:"start_at"`
+	Sig      string        `json:"sig,omitempty"`
+}
+
+func (t *TestSpec) sign(secret string) {
+	t.Sig = ""
+	t.Sig = hex.EncodeToString(specHMAC(secret, t))
+}
+
+func (t *TestSpec) verify(secret string) bool {
+	sig := t.Sig
+	t.Sig = ""
+	ok := hmac.Equal([]byte(sig), []byte(hex.EncodeToString(specHMAC(secret, t))))
+	t.Sig = sig
+	return ok
+}
+
+func specHMAC(secret string, t *TestSpec) []byte {
+	body, _ := json.Marshal(t)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// workerSample is one periodic report a worker streams back to the
+// coordinator while a run is in progress.
+type workerSample struct {
+	WorkerID string        `json:"worker_id"`
+	Sample   metricsSample `json:"sample"`
+}
+
+func writeFrame(w io.Writer, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(body)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+func readFrame(r io.Reader, v interface{}) error {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// RunCoordinator accepts nworkers worker registrations on addr, hands out a
+// signed TestSpec with a synchronized start timestamp, then aggregates the
+// periodic sample records workers stream back until they disconnect, and
+// prints a final combined report.
+func RunCoordinator(addr string, nworkers int, secret string, spec TestSpec) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Error("failed to listen for workers", "addr", addr, "err", err)
+		return err
+	}
+	logger.Info("coordinator listening", "addr", addr, "workers_expected", nworkers, "target", spec.Target)
+
+	type worker struct {
+		id   string
+		conn net.Conn
+	}
+	workers := make([]worker, 0, nworkers)
+	for len(workers) < nworkers {
+		conn, err := ln.Accept()
+		if err != nil {
+			logger.Error("failed to accept worker", "err", err)
+			continue
+		}
+		var hello workerHello
+		if err := readFrame(conn, &hello); err != nil {
+			logger.Error("failed reading worker hello", "err", err)
+			conn.Close()
+			continue
+		}
+		logger.Info("worker registered", "id", hello.ID, "capacity", hello.Capacity, "remote_addr", conn.RemoteAddr())
+		workers = append(workers, worker{id: hello.ID, conn: conn})
+	}
+
+	spec.StartAt = time.Now().Add(2 * time.Second)
+	spec.sign(secret)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	totals := make(map[string]metricsSample, len(workers))
+
+	for _, w := range workers {
+		if err := writeFrame(w.conn, spec); err != nil {
+			logger.Error("failed sending test spec", "worker", w.id, "err", err)
+			continue
+		}
+		wg.Add(1)
+		go func(w worker) {
+			defer wg.Done()
+			defer w.conn.Close()
+			for {
+				var s workerSample
+				if err := readFrame(w.conn, &s); err != nil {
+					return
+				}
+				mu.Lock()
+				totals[s.WorkerID] = s.Sample
+				mu.Unlock()
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	var bytesIn, bytesOut, requests int64
+	for id, s := range totals {
+		logger.Info("worker final sample", "worker", id, "bytes_in", s.BytesIn, "bytes_out", s.BytesOut, "requests", s.Requests)
+		bytesIn += s.BytesIn
+		bytesOut += s.BytesOut
+		requests += s.Requests
+	}
+	logger.Info("coordinator final report", "workers", len(totals), "bytes_in", bytesIn, "bytes_out", bytesOut, "requests", requests)
+	return nil
+}
+
+// RunWorker registers with the coordinator at addr, waits for the signed
+// TestSpec, sleeps until the synchronized start time, then runs the test
+// against spec.Target and streams periodic metrics samples back for the
+// duration of the run.
+func RunWorker(addr, id string, capacity int, secret string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		logger.Error("failed to connect to coordinator", "addr", addr, "err", err)
+		return err
+	}
+	defer conn.Close()
+
+	if err := writeFrame(conn, workerHello{ID: id, Capacity: capacity}); err != nil {
+		logger.Error("failed sending worker hello", "err", err)
+		return err
+	}
+
+	var spec TestSpec
+	if err := readFrame(conn, &spec); err != nil {
+		logger.Error("failed reading test spec", "err", err)
+		return err
+	}
+	if !spec.verify(secret) {
+		return fmt.Errorf("test spec signature invalid; refusing to run")
+	}
+	logger.Info("received test spec", "proto", spec.Proto, "target", spec.Target, "size", spec.Size,
+		"nconn", spec.Nconn, "duration", spec.Duration, "start_at", spec.StartAt)
+
+	if wait := time.Until(spec.StartAt); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	packetsize = &spec.Size
+	nflight = &spec.Nflight
+	b = make([]byte, spec.Size)
+
+	handler := ConnRead
+	if isPacketProto(spec.Proto) {
+		handler = PacketConnRead
+	}
+	if spec.Reqres {
+		handler = ReqResClient
+		go ReqResStats()
+	}
+
+	c := &Client{proto: spec.Proto, addr: spec.Target, handler: handler,
+		concurrency: spec.Nconn, size: spec.Size, nflight: spec.Nflight, reqres: spec.Reqres}
+	if err := c.ConnectAndGo(); err != nil {
+		logger.Error("worker failed to connect to target", "target", spec.Target, "err", err)
+		return err
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	deadline := time.Now().Add(spec.Duration)
+	for time.Now().Before(deadline) {
+		<-ticker.C
+		if err := writeFrame(conn, workerSample{WorkerID: id, Sample: takeSample()}); err != nil {
+			logger.Error("failed streaming sample to coordinator", "err", err)
+			return err
+		}
+	}
+	logger.Info("worker finished test duration", "worker", id)
+	return nil
+}
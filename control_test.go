@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestTestSpecSignVerify(t *testing.T) {
+	spec := TestSpec{Proto: "tcp", Target: "127.0.0.1:1234", Size: 1500, Nconn: 4}
+	spec.sign("shared-secret")
+
+	if !spec.verify("shared-secret") {
+		t.Fatal("verify failed with the signing secret")
+	}
+
+	if spec.verify("wrong-secret") {
+		t.Fatal("verify succeeded with the wrong secret")
+	}
+
+	tampered := spec
+	tampered.Size = spec.Size + 1
+	if tampered.verify("shared-secret") {
+		t.Fatal("verify succeeded after a field was tampered with")
+	}
+}
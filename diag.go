@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"time"
+)
+
+// Diagnostic command bytes, loosely mirroring the gops agent wire format:
+// a client dials -diag, writes a single command byte (plus, for profiling
+// commands, a big-endian uint32 duration in seconds), and reads the result
+// back off the same connection until EOF.
+const (
+	diagStackTrace  byte = 0x1
+	diagMemStats    byte = 0x3
+	diagGoroutines  byte = 0x7
+	diagCPUProfile  byte = 0x6
+	diagHeapProfile byte = 0x5
+	diagExecTrace   byte = 0x8
+)
+
+const defaultProfileDuration = 30 * time.Second
+
+// DiagListenAndGo binds an always-on diagnostic control endpoint so an
+// operator can pull memory stats, a goroutine stack dump, a CPU profile, a
+// heap profile or an execution trace from a running netperf process without
+// restarting it, superseding having to know a profile duration up front.
+func DiagListenAndGo(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Error("failed to listen for diag connections", "addr", addr, "err", err)
+		return err
+	}
+	logger.Info("diagnostics listening", "addr", addr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logger.Error("failed to accept diag connection", "err", err)
+			continue
+		}
+		go handleDiagConn(conn)
+	}
+	return nil
+}
+
+func handleDiagConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadByte()
+	if err != nil {
+		logger.Error("failed reading diag command", "err", err)
+		return
+	}
+
+	switch cmd {
+	case diagStackTrace:
+		buf := make([]byte, 1<<20)
+		n := runtime.Stack(buf, true)
+		conn.Write(buf[:n])
+
+	case diagMemStats:
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		fmt.Fprintf(conn, "%+v\n", m)
+
+	case diagGoroutines:
+		fmt.Fprintln(conn, runtime.NumGoroutine())
+
+	case diagCPUProfile:
+		d := readDiagDuration(r, defaultProfileDuration)
+		if err := pprof.StartCPUProfile(conn); err != nil {
+			fmt.Fprintln(conn, "cpu profile already in progress: ", err)
+			return
+		}
+		time.Sleep(d)
+		pprof.StopCPUProfile()
+
+	case diagHeapProfile:
+		pprof.WriteHeapProfile(conn)
+
+	case diagExecTrace:
+		d := readDiagDuration(r, 5*time.Second)
+		if err := trace.Start(conn); err != nil {
+			fmt.Fprintln(conn, "trace already in progress: ", err)
+			return
+		}
+		time.Sleep(d)
+		trace.Stop()
+
+	default:
+		fmt.Fprintln(conn, "unknown diagnostic command: ", cmd)
+	}
+}
+
+// readDiagDuration reads an optional big-endian uint32 seconds value
+// following a profiling command byte, falling back to def if the caller
+// didn't supply one.
+func readDiagDuration(r *bufio.Reader, def time.Duration) time.Duration {
+	var secs uint32
+	if err := binary.Read(r, binary.BigEndian, &secs); err != nil || secs == 0 {
+		return def
+	}
+	return time.Duration(secs) * time.Second
+}
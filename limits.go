@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/vys/go-humanize"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runWG tracks every handler goroutine spawned for the current run so main
+// can wait for them to unwind cleanly before printing the final summary,
+// instead of the process living forever until it's killed.
+var runWG sync.WaitGroup
+
+// byteUnits maps the size suffixes parseBytes understands to their
+// multiplier, longest/most specific suffix first so e.g. "KiB" is matched
+// before the generic "B".
+var byteUnits = []struct {
+	suffix string
+	factor uint64
+}{
+	{"TiB", 1 << 40}, {"TB", 1e12},
+	{"GiB", 1 << 30}, {"GB", 1e9},
+	{"MiB", 1 << 20}, {"MB", 1e6},
+	{"KiB", 1 << 10}, {"KB", 1e3},
+	{"B", 1},
+}
+
+// parseBytes parses a human-readable byte quantity like "10GiB", "1.5MB" or
+// a bare number of bytes. go-humanize only offers a formatter (Bytes), not a
+// parser, so this is the -bytes flag's own inverse of it.
+func parseBytes(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	for _, u := range byteUnits {
+		if !strings.HasSuffix(s, u.suffix) {
+			continue
+		}
+		numPart := strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+		f, err := strconv.ParseFloat(numPart, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid byte size %q: %w", s, err)
+		}
+		return uint64(f * float64(u.factor)), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size %q: %w", s, err)
+	}
+	return uint64(f), nil
+}
+
+// newRunContext builds the context a bounded run is canceled through: after
+// duration elapses (if set) or once limitBytes worth of traffic has moved (if
+// set), whichever comes first. A goroutine watching the context closes every
+// open connection in response, which is what actually unblocks the handlers'
+// Read/Write loops.
+func newRunContext(duration time.Duration, limitBytes uint64) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if duration > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), duration)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	if limitBytes > 0 {
+		go watchByteLimit(ctx, limitBytes, cancel)
+	}
+	go closeConnsOnDone(ctx)
+	return ctx, cancel
+}
+
+// watchByteLimit cancels ctx once the aggregate bytes moved across every
+// tracked connection reaches limitBytes.
+func watchByteLimit(ctx context.Context, limitBytes uint64, cancel context.CancelFunc) {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s := takeSample()
+			if uint64(s.BytesIn+s.BytesOut) >= limitBytes {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// closeConnsOnDone closes every open connection as soon as ctx is canceled,
+// so the blocking handler loops in conn.go/udp.go see an error and return
+// instead of the run having to be killed from outside.
+func closeConnsOnDone(ctx context.Context) {
+	<-ctx.Done()
+	logger.Info("run limit reached; closing connections")
+	closeAllConns()
+}
+
+// printFinalSummary reports what a bounded run moved in total: elapsed time,
+// bytes, mean throughput over the whole run, and cumulative GC pause time,
+// in place of the periodic samples MetricsReporter prints while a run is
+// still going. No instantaneous throughput figure is reported.
+func printFinalSummary(start time.Time) {
+	s := takeSample()
+	elapsed := time.Since(start)
+	totalBytes := s.BytesIn + s.BytesOut
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	var meanThroughput float64
+	if elapsed > 0 {
+		meanThroughput = float64(totalBytes) / elapsed.Seconds()
+	}
+
+	logger.Info("run finished",
+		"elapsed", elapsed,
+		"bytes_in", s.BytesIn, "bytes_out", s.BytesOut,
+		"requests", s.Requests,
+		"mean_throughput_bytes_per_sec", humanize.Bytes(uint64(meanThroughput)),
+		"gc_pause_total", time.Duration(m.PauseTotalNs))
+}
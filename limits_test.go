@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestParseBytes(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    uint64
+		wantErr bool
+	}{
+		{"500", 500, false},
+		{"1KB", 1000, false},
+		{"1KiB", 1024, false},
+		{"10GiB", 10 * (1 << 30), false},
+		{"1.5MB", 1500000, false},
+		{"", 0, true},
+		{"notabyte", 0, true},
+	}
+	for _, c := range cases {
+		got, err := parseBytes(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseBytes(%q): expected error, got %d", c.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseBytes(%q): unexpected error: %v", c.in, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parseBytes(%q) = %d, want %d", c.in, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// logger is the package-wide structured logger. All event logging (failures,
+// connection lifecycle, periodic samples) goes through it instead of the
+// unstructured log.Println calls this program started with, so output can be
+// consumed by other tools.
+var logger *slog.Logger
+
+// initLogger configures logger according to -log-format ("text" or "json").
+func initLogger(format string) {
+	var handler slog.Handler
+	switch format {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stdout, nil)
+	default:
+		handler = slog.NewTextHandler(os.Stdout, nil)
+	}
+	logger = slog.New(handler)
+	slog.SetDefault(logger)
+}
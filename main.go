@@ -1,14 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"github.com/vys/go-humanize"
-	"io"
-	"log"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
-	"runtime"
 	"runtime/pprof"
 	"strconv"
 	"syscall"
@@ -18,13 +16,14 @@ import (
 type Server struct {
 	proto   string
 	addr    string
-	handler func(c *net.TCPConn) error
+	handler func(c net.Conn) error
+	ctx     context.Context
 }
 
 type Client struct {
 	proto       string
 	addr        string
-	handler     func(c *net.TCPConn) error
+	handler     func(c net.Conn) error
 	concurrency int
 	size        int
 	nflight     int
@@ -32,104 +31,9 @@ type Client struct {
 	saddr       string
 }
 
-func (s *Server) ListenAndGo() error {
-	tcpaddr, err := net.ResolveTCPAddr(s.proto, s.addr)
-	if err != nil {
-		log.Println("Failed to resolve ", s.addr, " with error: ", err)
-		return err
-	}
-	ln, err := net.ListenTCP(s.proto, tcpaddr)
-	if err != nil {
-		log.Println("Failed to listen for tcp connections on address ", s.addr, " with error: ", err)
-		return err
-	}
-
-	for {
-		conn, err := ln.AcceptTCP()
-		if err != nil {
-			log.Println("Failed to accept connection ", conn, " with error ", err)
-			continue
-		}
-		log.Println("Client ", conn.RemoteAddr(), " connected")
-		go s.handler(conn)
-	}
-	return nil
-}
-
-func (c *Client) NewConnection() (*net.TCPConn, error) {
-	srcTcpAddr, err := net.ResolveTCPAddr(c.proto, c.saddr)
-	if err != nil {
-		log.Println("Failed to resolve ", c.saddr)
-		return nil, err
-	}
-	dstTcpAddr, err := net.ResolveTCPAddr(c.proto, c.addr)
-	if err != nil {
-		log.Println("Failed to resolve ", c.addr)
-		return nil, err
-	}
-	return net.DialTCP(c.proto, srcTcpAddr, dstTcpAddr)
-}
-
-func (c *Client) ConnectAndGo() error {
-	conns := make([]*net.TCPConn, c.concurrency)
-	for i := 0; i < c.concurrency; i++ {
-		conn, err := c.NewConnection()
-		if err != nil {
-			log.Println("Failed to connect to tcp server on address ", c.addr, " from source address: ", c.saddr, " Error: ", err)
-			conn.Close()
-			return err
-		}
-		log.Println("Client ", conn.LocalAddr(), " connected to ", conn.RemoteAddr())
-		conns[i] = conn
-	}
-	for i := 0; i < c.concurrency; i++ {
-		go c.handler(conns[i])
-	}
-	return nil
-}
-
-func TCPConnRead(c *net.TCPConn) error {
-	c.SetReadBuffer(*packetsize)
-	for {
-		_, err := c.Read(b)
-		if err != nil {
-			if err == io.EOF {
-				log.Println("Client ", c.RemoteAddr(), " disconnected")
-				c.Close()
-				return nil
-			} else {
-				log.Println("Failed reading bytes from conn: ", c, " with error ", err)
-				c.Close()
-				return err
-			}
-		}
-	}
-	return nil
-}
-
-var b []byte
-
-func TCPConnWrite(c *net.TCPConn) error {
-	c.SetWriteBuffer(*packetsize)
-
-	for {
-		_, err := c.Write(b)
-		if err != nil {
-			if err == io.EOF {
-				log.Println("Client ", c.RemoteAddr(), " disconnected")
-				c.Close()
-				return nil
-			} else {
-				log.Println("Failed writing bytes to conn: ", c, " with error ", err)
-				c.Close()
-				return err
-			}
-		}
-	}
-	return nil
-}
-
 var packetsize *int
+var nflight *int
+var reqres *bool
 
 func main() {
 
@@ -140,76 +44,154 @@ func main() {
 	listen := flag.Bool("listen", false, "Listen")
 	packetsize = flag.Int("size", 1500, "Size of packets to send")
 	nconn := flag.Int("nconn", 254, "Number of concurrent connections")
-	reqres := flag.Bool("reqres", false, "Request/Response protocol")
-	nflight := flag.Int("nflight", 1024, "Number of requests in flight before waiting for response")
+	reqres = flag.Bool("reqres", false, "Request/Response protocol")
+	nflight = flag.Int("nflight", 1024, "Number of requests in flight before waiting for response")
+	proto := flag.String("proto", "tcp", "Network protocol: tcp, tcp4, tcp6, udp, udp4, udp6, unix, unixgram")
+	sockpath := flag.String("sockpath", "/tmp/netperf.sock", "Unix socket path (used when -proto is unix or unixgram)")
+	diag := flag.String("diag", "", "Address to bind the diagnostic control endpoint to (disabled if empty)")
+	sndbuf = flag.Int("sndbuf", 0, "Socket send buffer size in bytes (0 = OS default)")
+	rcvbuf = flag.Int("rcvbuf", 0, "Socket receive buffer size in bytes (0 = OS default)")
+	nodelay = flag.Bool("nodelay", true, "Disable Nagle's algorithm (TCP_NODELAY)")
+	keepalive = flag.Duration("keepalive", 0, "TCP keepalive probe interval (0 = disabled)")
+	linger = flag.Int("linger", -1, "SO_LINGER timeout in seconds (-1 = OS default)")
+	cork = flag.Bool("cork", false, "Enable TCP_CORK to batch small writes")
+	logFormat := flag.String("log-format", "text", "Event log output format: text or json")
+	interval := flag.Duration("interval", 5*time.Second, "Metrics sampling interval")
+	metricsFormat := flag.String("metrics-format", "text", "Metrics sample output format: text, csv, json, or prometheus")
+	metricsAddr := flag.String("metrics-addr", ":9100", "Address to serve Prometheus metrics on (used when -metrics-format is prometheus)")
 	profile := flag.String("profile", "", "write profile to file with following prefix")
+	control := flag.String("control", "", "Control subsystem role: coordinator, worker, or empty to run a standalone client/server")
+	controlAddr := flag.String("control-addr", "127.0.0.1:14000", "Control channel address: coordinator binds it, workers dial it")
+	controlSecret := flag.String("control-secret", "", "Shared secret used to sign and verify the test spec")
+	controlWorkers := flag.Int("control-workers", 1, "Number of workers the coordinator waits for before starting the run")
+	controlID := flag.String("control-id", "", "Worker identifier reported to the coordinator (defaults to -host:-port)")
+	duration := flag.Duration("duration", 0, "Stop after this long (0 = unbounded; a coordinated control-mode run defaults to 30s if unset)")
+	bytesLimit := flag.String("bytes", "", "Stop after transferring this many bytes total, e.g. 10GiB (unbounded if empty)")
 	flag.Parse()
 
+	initLogger(*logFormat)
+
 	if *profile != "" {
 		go doprofile(*profile)
 	}
 
+	if *diag != "" {
+		go DiagListenAndGo(*diag)
+	}
+
 	if flag.NArg() != 0 {
-		log.Println("Usage:")
+		fmt.Println("Usage:")
 		flag.PrintDefaults()
 		return
 	}
 
+	if isPacketProto(*proto) && *packetsize < 8 {
+		logger.Error("-size must be at least 8 bytes on packet protocols; the sequence number is stored in the first 8 bytes of every datagram", "proto", *proto, "size", *packetsize)
+		os.Exit(1)
+	}
+
 	b = make([]byte, *packetsize)
 
-	go GoRuntimeStats()
+	addr, saddr := *sockpath, ""
+	if !isUnixProto(*proto) {
+		addr = net.JoinHostPort(*host, *port)
+		saddr = net.JoinHostPort(*shost, *sport)
+	}
+
+	go MetricsReporter(*interval, *metricsFormat, *metricsAddr)
+
+	if *control == "coordinator" {
+		specDuration := *duration
+		if specDuration <= 0 {
+			specDuration = 30 * time.Second
+		}
+		spec := TestSpec{Proto: *proto, Target: addr, Size: *packetsize, Nconn: *nconn,
+			Duration: specDuration, Reqres: *reqres, Nflight: *nflight}
+		RunCoordinator(*controlAddr, *controlWorkers, *controlSecret, spec)
+		return
+	}
+
+	if *control == "worker" {
+		id := *controlID
+		if id == "" {
+			id = net.JoinHostPort(*host, *port)
+		}
+		RunWorker(*controlAddr, id, *nconn, *controlSecret)
+		return
+	}
+
+	var limitBytes uint64
+	if *bytesLimit != "" {
+		lim, err := parseBytes(*bytesLimit)
+		if err != nil {
+			logger.Error("invalid -bytes value", "value", *bytesLimit, "err", err)
+			os.Exit(1)
+		}
+		limitBytes = lim
+	}
+	bounded := *duration > 0 || limitBytes > 0
+	ctx, cancel := newRunContext(*duration, limitBytes)
+	defer cancel()
+
+	start := time.Now()
 
 	if *listen {
 
-		s := &Server{proto: "tcp", addr: net.JoinHostPort(*host, *port), handler: TCPConnWrite}
+		handler := ConnWrite
+		if isPacketProto(*proto) {
+			handler = PacketConnWrite
+		}
+		if *reqres {
+			handler = ReqResServer
+		}
+		s := &Server{proto: *proto, addr: addr, handler: handler, ctx: ctx}
 		s.ListenAndGo()
 
 	} else {
-		c := &Client{proto: "tcp", addr: net.JoinHostPort(*host, *port), handler: TCPConnRead,
+		handler := ConnRead
+		if isPacketProto(*proto) {
+			handler = PacketConnRead
+		}
+		if *reqres {
+			handler = ReqResClient
+			go ReqResStats()
+		}
+		c := &Client{proto: *proto, addr: addr, handler: handler,
 			size: *packetsize, concurrency: *nconn, nflight: *nflight, reqres: *reqres,
-			saddr: net.JoinHostPort(*shost, *sport)}
+			saddr: saddr}
 
 		c.ConnectAndGo()
 
-		SigIntHandler()
+		if !bounded {
+			SigIntHandler()
+		}
+	}
+
+	if bounded {
+		<-ctx.Done()
+		runWG.Wait()
+		printFinalSummary(start)
 	}
 
-	log.Println("Finished execution!")
+	logger.Info("finished execution")
 }
 
 func SigIntHandler() {
 	ch := make(chan os.Signal)
 	signal.Notify(ch, syscall.SIGINT)
 	<-ch
-	log.Println("CTRL-C; exiting")
+	logger.Info("ctrl-c; exiting")
 	os.Exit(0)
 }
 
-func GoRuntimeStats() {
-	m := new(runtime.MemStats)
-	for {
-		time.Sleep(5 * time.Second)
-		log.Println("# goroutines: ", runtime.NumGoroutine())
-		runtime.ReadMemStats(m)
-		log.Println("Memory Acquired: ", humanize.Bytes(m.Sys))
-		log.Println("Memory Used    : ", humanize.Bytes(m.Alloc))
-		log.Println("# malloc       : ", m.Mallocs)
-		log.Println("# free         : ", m.Frees)
-		log.Println("GC enabled     : ", m.EnableGC)
-		log.Println("# GC           : ", m.NumGC)
-		log.Println("Last GC time   : ", m.LastGC)
-		log.Println("Next GC        : ", humanize.Bytes(m.NextGC))
-		//runtime.GC()
-	}
-}
-
 func doprofile(fn string) {
 	var err error
 	var fc, fh, ft *os.File
 	for i := 1; i > 0; i++ {
 		fc, err = os.Create(fn + "-cpu-" + strconv.Itoa(i) + ".prof")
 		if err != nil {
-			log.Fatal(err)
+			logger.Error("failed to create cpu profile file", "err", err)
+			os.Exit(1)
 		}
 
 		pprof.StartCPUProfile(fc)
@@ -219,17 +201,19 @@ func doprofile(fn string) {
 
 		fh, err = os.Create(fn + "-heap-" + strconv.Itoa(i) + ".prof")
 		if err != nil {
-			log.Fatal(err)
+			logger.Error("failed to create heap profile file", "err", err)
+			os.Exit(1)
 		}
 		pprof.WriteHeapProfile(fh)
 		fh.Close()
 
 		ft, err = os.Create(fn + "-threadcreate-" + strconv.Itoa(i) + ".prof")
 		if err != nil {
-			log.Fatal(err)
+			logger.Error("failed to create threadcreate profile file", "err", err)
+			os.Exit(1)
 		}
 		pprof.Lookup("threadcreate").WriteTo(ft, 0)
 		ft.Close()
-		log.Println("Created CPU, heap and threadcreate profile of 300 seconds")
+		logger.Info("created cpu, heap, and threadcreate profile", "duration", "300s")
 	}
 }
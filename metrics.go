@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/vys/go-humanize"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connStats tracks cumulative bytes moved over a single connection so
+// MetricsReporter can report per-connection throughput.
+type connStats struct {
+	bytesIn  int64
+	bytesOut int64
+}
+
+func (cs *connStats) addIn(n int)  { atomic.AddInt64(&cs.bytesIn, int64(n)) }
+func (cs *connStats) addOut(n int) { atomic.AddInt64(&cs.bytesOut, int64(n)) }
+
+var (
+	connStatsMu   sync.Mutex
+	connStatsByID = make(map[string]*connStats)
+	openConnsByID = make(map[string]net.Conn)
+
+	// closedBytesIn/closedBytesOut accumulate the final totals of connections
+	// that have already been unregistered, so a connection closing doesn't
+	// erase its contribution to the run's aggregate byte counts.
+	closedBytesIn  int64
+	closedBytesOut int64
+)
+
+// connID identifies a connection for per-connection metrics and for
+// closeAllConns. Remote address alone isn't enough: every client connection
+// in a multi-conn run shares the same RemoteAddr, so it's paired with the
+// local address (unique per outbound connection; inbound clients share the
+// local address and differ by remote address) and falls back to the conn's
+// pointer when either address is unavailable (e.g. unnamed unix sockets).
+func connID(c net.Conn) string {
+	la, ra := c.LocalAddr(), c.RemoteAddr()
+	if la != nil && ra != nil && la.String() != "" && ra.String() != "" {
+		return la.String() + "->" + ra.String()
+	}
+	return fmt.Sprintf("%p", c)
+}
+
+func registerConn(c net.Conn) *connStats {
+	cs := &connStats{}
+	connStatsMu.Lock()
+	connStatsByID[connID(c)] = cs
+	openConnsByID[connID(c)] = c
+	connStatsMu.Unlock()
+	return cs
+}
+
+func unregisterConn(c net.Conn) {
+	id := connID(c)
+	connStatsMu.Lock()
+	if cs, ok := connStatsByID[id]; ok {
+		atomic.AddInt64(&closedBytesIn, atomic.LoadInt64(&cs.bytesIn))
+		atomic.AddInt64(&closedBytesOut, atomic.LoadInt64(&cs.bytesOut))
+	}
+	delete(connStatsByID, id)
+	delete(openConnsByID, id)
+	connStatsMu.Unlock()
+}
+
+// closeAllConns closes every currently tracked connection; it's how a bounded
+// run unblocks handlers sitting in a Read or Write call once its duration or
+// byte limit is hit.
+func closeAllConns() {
+	connStatsMu.Lock()
+	defer connStatsMu.Unlock()
+	for _, c := range openConnsByID {
+		c.Close()
+	}
+}
+
+// metricsSample is one row of the periodic metrics report: per-connection
+// and aggregate throughput, request/packet counts, and goroutine, memory and
+// GC stats.
+type metricsSample struct {
+	Timestamp   time.Time              `json:"timestamp"`
+	Connections map[string]connSummary `json:"connections"`
+	BytesIn     int64                  `json:"bytes_in"`
+	BytesOut    int64                  `json:"bytes_out"`
+	Requests    int64                  `json:"requests"`
+	PacketsSent int64                  `json:"packets_sent"`
+	PacketsRecv int64                  `json:"packets_received"`
+	PacketsLost int64                  `json:"packets_lost"`
+	Goroutines  int                    `json:"goroutines"`
+	MemAlloc    uint64                 `json:"mem_alloc"`
+	MemSys      uint64                 `json:"mem_sys"`
+	NumGC       uint32                 `json:"num_gc"`
+}
+
+type connSummary struct {
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// sortedConnIDs returns a sample's connection IDs in a stable order, so the
+// per-connection rows the csv/text/prometheus outputs add are reproducible
+// from one sample to the next.
+func (s metricsSample) sortedConnIDs() []string {
+	ids := make([]string, 0, len(s.Connections))
+	for id := range s.Connections {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func takeSample() metricsSample {
+	connStatsMu.Lock()
+	conns := make(map[string]connSummary, len(connStatsByID))
+	var bytesIn, bytesOut int64
+	for id, cs := range connStatsByID {
+		in := atomic.LoadInt64(&cs.bytesIn)
+		out := atomic.LoadInt64(&cs.bytesOut)
+		conns[id] = connSummary{BytesIn: in, BytesOut: out}
+		bytesIn += in
+		bytesOut += out
+	}
+	bytesIn += atomic.LoadInt64(&closedBytesIn)
+	bytesOut += atomic.LoadInt64(&closedBytesOut)
+	connStatsMu.Unlock()
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	return metricsSample{
+		Timestamp:   time.Now(),
+		Connections: conns,
+		BytesIn:     bytesIn,
+		BytesOut:    bytesOut,
+		Requests:    reqresStats.requestCount(),
+		PacketsSent: atomic.LoadInt64(&packetsSent),
+		PacketsRecv: atomic.LoadInt64(&packetsReceived),
+		PacketsLost: atomic.LoadInt64(&packetsLost),
+		Goroutines:  runtime.NumGoroutine(),
+		MemAlloc:    m.Alloc,
+		MemSys:      m.Sys,
+		NumGC:       m.NumGC,
+	}
+}
+
+var csvHeader = []string{
+	"timestamp", "conn_id", "bytes_in", "bytes_out", "requests",
+	"packets_sent", "packets_received", "packets_lost",
+	"goroutines", "mem_alloc", "mem_sys", "num_gc",
+}
+
+// csvRows renders the sample as one aggregate row (conn_id "_aggregate")
+// followed by one row per connection, so CSV consumers get the same
+// per-connection breakdown the json format carries in s.Connections. The
+// per-connection rows only have bytes_in/bytes_out populated; the rest of
+// the columns are aggregate-only and left blank.
+func (s metricsSample) csvRows() [][]string {
+	ts := s.Timestamp.Format(time.RFC3339)
+	rows := make([][]string, 0, 1+len(s.Connections))
+	rows = append(rows, []string{
+		ts, "_aggregate",
+		strconv.FormatInt(s.BytesIn, 10),
+		strconv.FormatInt(s.BytesOut, 10),
+		strconv.FormatInt(s.Requests, 10),
+		strconv.FormatInt(s.PacketsSent, 10),
+		strconv.FormatInt(s.PacketsRecv, 10),
+		strconv.FormatInt(s.PacketsLost, 10),
+		strconv.Itoa(s.Goroutines),
+		strconv.FormatUint(s.MemAlloc, 10),
+		strconv.FormatUint(s.MemSys, 10),
+		strconv.FormatUint(uint64(s.NumGC), 10),
+	})
+	for _, id := range s.sortedConnIDs() {
+		cs := s.Connections[id]
+		rows = append(rows, []string{
+			ts, id,
+			strconv.FormatInt(cs.BytesIn, 10),
+			strconv.FormatInt(cs.BytesOut, 10),
+			"", "", "", "", "", "", "", "",
+		})
+	}
+	return rows
+}
+
+// MetricsReporter samples throughput and runtime stats every interval and
+// emits them in the requested format: text (through logger), csv, json, or
+// prometheus (served over HTTP rather than emitted on our own schedule).
+func MetricsReporter(interval time.Duration, format, addr string) {
+	if format == "prometheus" {
+		servePrometheus(addr)
+		return
+	}
+
+	csvWriter := csv.NewWriter(os.Stdout)
+	wroteCSVHeader := false
+
+	for {
+		time.Sleep(interval)
+		s := takeSample()
+
+		switch format {
+		case "json":
+			b, err := json.Marshal(s)
+			if err != nil {
+				logger.Error("failed to marshal metrics sample", "err", err)
+				continue
+			}
+			fmt.Println(string(b))
+		case "csv":
+			if !wroteCSVHeader {
+				csvWriter.Write(csvHeader)
+				wroteCSVHeader = true
+			}
+			for _, row := range s.csvRows() {
+				csvWriter.Write(row)
+			}
+			csvWriter.Flush()
+		default:
+			logger.Info("metrics sample",
+				"bytes_in", s.BytesIn, "bytes_out", s.BytesOut,
+				"requests", s.Requests,
+				"packets_sent", s.PacketsSent, "packets_received", s.PacketsRecv, "packets_lost", s.PacketsLost,
+				"goroutines", s.Goroutines,
+				"mem_alloc", humanize.Bytes(s.MemAlloc), "mem_sys", humanize.Bytes(s.MemSys), "num_gc", s.NumGC)
+			for _, id := range s.sortedConnIDs() {
+				cs := s.Connections[id]
+				logger.Info("metrics sample connection", "conn", id, "bytes_in", cs.BytesIn, "bytes_out", cs.BytesOut)
+			}
+		}
+	}
+}
+
+// servePrometheus exposes the current metrics sample on addr in Prometheus
+// text exposition format.
+func servePrometheus(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		s := takeSample()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintf(w, "netperf_bytes_in %d\n", s.BytesIn)
+		fmt.Fprintf(w, "netperf_bytes_out %d\n", s.BytesOut)
+		fmt.Fprintf(w, "netperf_requests_total %d\n", s.Requests)
+		fmt.Fprintf(w, "netperf_packets_sent_total %d\n", s.PacketsSent)
+		fmt.Fprintf(w, "netperf_packets_received_total %d\n", s.PacketsRecv)
+		fmt.Fprintf(w, "netperf_packets_lost_total %d\n", s.PacketsLost)
+		fmt.Fprintf(w, "netperf_goroutines %d\n", s.Goroutines)
+		fmt.Fprintf(w, "netperf_mem_alloc_bytes %d\n", s.MemAlloc)
+		fmt.Fprintf(w, "netperf_mem_sys_bytes %d\n", s.MemSys)
+		fmt.Fprintf(w, "netperf_gc_total %d\n", s.NumGC)
+		for _, id := range s.sortedConnIDs() {
+			cs := s.Connections[id]
+			fmt.Fprintf(w, "netperf_conn_bytes_in{conn=%q} %d\n", id, cs.BytesIn)
+			fmt.Fprintf(w, "netperf_conn_bytes_out{conn=%q} %d\n", id, cs.BytesOut)
+		}
+	})
+
+	logger.Info("prometheus metrics endpoint listening", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error("prometheus metrics endpoint failed", "addr", addr, "err", err)
+	}
+}
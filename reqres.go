@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// reqResMetrics accumulates per-request latency samples and byte counts for
+// the request/response (ping-pong) mode, reported periodically by ReqResStats.
+type reqResMetrics struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	count   int64
+	bytes   int64
+	start   time.Time
+}
+
+var reqresStats = &reqResMetrics{start: time.Now()}
+
+func (m *reqResMetrics) record(d time.Duration, n int) {
+	m.mu.Lock()
+	m.samples = append(m.samples, d)
+	m.count++
+	m.bytes += int64(n)
+	m.mu.Unlock()
+}
+
+func (m *reqResMetrics) requestCount() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.count
+}
+
+// report logs latency/throughput stats for the requests seen since the
+// previous report and drops its sample buffer, so a long-running (e.g.
+// -duration-bounded) reqres test doesn't sort an ever-growing history on
+// every tick.
+func (m *reqResMetrics) report() {
+	m.mu.Lock()
+	if len(m.samples) == 0 {
+		m.mu.Unlock()
+		return
+	}
+	sorted := m.samples
+	m.samples = nil
+	count := m.count
+	bytes := m.bytes
+	elapsed := time.Since(m.start)
+	m.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	pct := func(p float64) time.Duration {
+		idx := int(p * float64(len(sorted)-1))
+		return sorted[idx]
+	}
+
+	logger.Info("request/response stats",
+		"requests", count,
+		"throughput_bytes_per_sec", uint64(float64(bytes)/elapsed.Seconds()),
+		"latency_min", sorted[0],
+		"latency_avg", sum/time.Duration(len(sorted)),
+		"latency_p50", pct(0.50),
+		"latency_p95", pct(0.95),
+		"latency_p99", pct(0.99))
+}
+
+// ReqResStats logs request/response stats every 5 seconds: the request count
+// and throughput are cumulative, the latency figures cover only the requests
+// completed since the previous report.
+func ReqResStats() {
+	for {
+		time.Sleep(5 * time.Second)
+		reqresStats.report()
+	}
+}
+
+// ReqResClient drives the client side of request/response mode: it keeps
+// up to *nflight requests outstanding at once, tracking the semaphore with a
+// buffered channel, and matches each response to its send time in FIFO order
+// to compute per-request latency.
+func ReqResClient(c net.Conn) error {
+	stats := registerConn(c)
+	defer unregisterConn(c)
+
+	sem := make(chan struct{}, *nflight)
+	sendTimes := make(chan time.Time, *nflight)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			sendTimes <- time.Now()
+			if _, err := c.Write(b); err != nil {
+				logger.Error("failed writing request to conn", "remote_addr", c.RemoteAddr(), "err", err)
+				c.Close()
+				return
+			}
+			stats.addOut(len(b))
+		}
+	}()
+
+	resp := make([]byte, *packetsize)
+	for {
+		if _, err := io.ReadFull(c, resp); err != nil {
+			if err == io.EOF {
+				logger.Info("client disconnected", "remote_addr", c.RemoteAddr())
+				return nil
+			}
+			logger.Error("failed reading response from conn", "remote_addr", c.RemoteAddr(), "err", err)
+			c.Close()
+			return err
+		}
+		stats.addIn(len(resp))
+		start := <-sendTimes
+		reqresStats.record(time.Since(start), len(resp))
+		<-sem
+	}
+	return nil
+}
+
+// ReqResServer drives the server side of request/response mode: it reads
+// a fixed-size request and echoes it straight back.
+func ReqResServer(c net.Conn) error {
+	stats := registerConn(c)
+	defer unregisterConn(c)
+
+	req := make([]byte, *packetsize)
+	for {
+		if _, err := io.ReadFull(c, req); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				logger.Info("client disconnected", "remote_addr", c.RemoteAddr())
+				c.Close()
+				return nil
+			}
+			logger.Error("failed reading request from conn", "remote_addr", c.RemoteAddr(), "err", err)
+			c.Close()
+			return err
+		}
+		stats.addIn(len(req))
+		if _, err := c.Write(req); err != nil {
+			logger.Error("failed writing response to conn", "remote_addr", c.RemoteAddr(), "err", err)
+			c.Close()
+			return err
+		}
+		stats.addOut(len(req))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+var sndbuf *int
+var rcvbuf *int
+var nodelay *bool
+var keepalive *time.Duration
+var linger *int
+var cork *bool
+
+// tuneConn applies the -sndbuf/-rcvbuf/-nodelay/-keepalive/-linger/-cork
+// socket options to c immediately after it's accepted or dialed, mirroring
+// the pattern of setting KeepAlive/SndBuf/RcvBuf right after AcceptTCP.
+func tuneConn(c net.Conn) {
+	setBuffers(c, *rcvbuf, *sndbuf)
+
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetNoDelay(*nodelay)
+
+		if *keepalive > 0 {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(*keepalive)
+		} else {
+			tc.SetKeepAlive(false)
+		}
+
+		if *linger >= 0 {
+			tc.SetLinger(*linger)
+		}
+
+		if *cork {
+			setCork(tc, true)
+		}
+	}
+
+	logActualBuffers(c)
+}
+
+// tunePacketConn applies -sndbuf/-rcvbuf to the shared listener socket used
+// by the connectionless transports, since there's no per-client accept to
+// hook into the way there is for streams.
+func tunePacketConn(pc net.PacketConn) {
+	if bs, ok := pc.(bufSetter); ok {
+		if *rcvbuf > 0 {
+			bs.SetReadBuffer(*rcvbuf)
+		}
+		if *sndbuf > 0 {
+			bs.SetWriteBuffer(*sndbuf)
+		}
+	}
+	if c, ok := pc.(net.Conn); ok {
+		logActualBuffers(c)
+	}
+}
+
+// setCork toggles TCP_CORK so a batch of small writes can be coalesced into
+// fewer packets.
+func setCork(tc *net.TCPConn, on bool) {
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		logger.Error("failed to get raw conn", "conn", tc, "err", err)
+		return
+	}
+	val := 0
+	if on {
+		val = 1
+	}
+	raw.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CORK, val)
+	})
+}
+
+// logActualBuffers reads back SO_RCVBUF/SO_SNDBUF via getsockopt so users can
+// see what the kernel granted vs. what was requested.
+func logActualBuffers(c net.Conn) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	var rb, wb int
+	var rerr, werr error
+	raw.Control(func(fd uintptr) {
+		rb, rerr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		wb, werr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	if rerr == nil && werr == nil {
+		logger.Info("socket buffers", "remote_addr", c.RemoteAddr(), "rcvbuf", rb, "sndbuf", wb)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpConn adapts a shared, connectionless net.PacketConn plus a fixed remote
+// address into something that satisfies net.Conn, so the same handler
+// functions used for TCP/unix work unmodified against UDP and unixgram
+// clients on the server side. Incoming datagrams are fed in by the
+// dispatcher loop in listenAndGoPacket.
+type udpConn struct {
+	pc        net.PacketConn
+	raddr     net.Addr
+	in        chan []byte
+	closeOnce sync.Once
+}
+
+func (u *udpConn) Read(p []byte) (int, error) {
+	pkt, ok := <-u.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(p, pkt), nil
+}
+
+func (u *udpConn) Write(p []byte) (int, error) {
+	return u.pc.WriteTo(p, u.raddr)
+}
+
+// Close unblocks a pending Read by closing the dispatch channel; it doesn't
+// touch the shared listener socket, since other clients are still using it.
+func (u *udpConn) Close() error {
+	u.closeOnce.Do(func() { close(u.in) })
+	return nil
+}
+func (u *udpConn) LocalAddr() net.Addr                { return u.pc.LocalAddr() }
+func (u *udpConn) RemoteAddr() net.Addr               { return u.raddr }
+func (u *udpConn) SetDeadline(t time.Time) error      { return nil }
+func (u *udpConn) SetReadDeadline(t time.Time) error  { return nil }
+func (u *udpConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// listenAndGoPacket handles the connectionless transports (udp*, unixgram).
+// A single shared PacketConn receives datagrams from every client; the
+// dispatcher demuxes them by source address into a per-client udpConn so the
+// rest of the program can keep treating every transport as a net.Conn.
+func (s *Server) listenAndGoPacket() error {
+	pc, err := net.ListenPacket(s.proto, s.addr)
+	if err != nil {
+		logger.Error("failed to listen for packets", "addr", s.addr, "err", err)
+		return err
+	}
+	tunePacketConn(pc)
+	go func() {
+		<-s.ctx.Done()
+		pc.Close()
+	}()
+
+	var mu sync.Mutex
+	clients := make(map[string]*udpConn)
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return nil
+			default:
+			}
+			logger.Error("failed reading packet", "addr", s.addr, "err", err)
+			continue
+		}
+
+		mu.Lock()
+		uc, ok := clients[addr.String()]
+		if !ok {
+			uc = &udpConn{pc: pc, raddr: addr, in: make(chan []byte, 1024)}
+			clients[addr.String()] = uc
+			logger.Info("client connected", "remote_addr", addr)
+			runWG.Add(1)
+			go func() {
+				defer runWG.Done()
+				s.handler(uc)
+			}()
+		}
+		mu.Unlock()
+
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+		uc.in <- pkt
+	}
+	return nil
+}
+
+// Datagram framing accounting for the packet transports: the sequence
+// number embedded in the first 8 bytes of every datagram lets the reader
+// detect gaps and report loss.
+var packetsSent int64
+var packetsReceived int64
+var packetsLost int64
+
+// PacketConnWrite sends fixed-size, sequence-numbered datagrams so the
+// receiving side can compute loss.
+func PacketConnWrite(c net.Conn) error {
+	stats := registerConn(c)
+	defer unregisterConn(c)
+
+	pkt := make([]byte, *packetsize)
+	var seq uint64
+	for {
+		binary.BigEndian.PutUint64(pkt[:8], seq)
+		_, err := c.Write(pkt)
+		if err != nil {
+			logger.Error("failed writing packet to conn", "remote_addr", c.RemoteAddr(), "err", err)
+			c.Close()
+			return err
+		}
+		stats.addOut(len(pkt))
+		seq++
+		atomic.AddInt64(&packetsSent, 1)
+	}
+	return nil
+}
+
+// PacketConnRead receives datagrams and tracks loss from gaps in the
+// sequence number embedded by PacketConnWrite.
+func PacketConnRead(c net.Conn) error {
+	stats := registerConn(c)
+	defer unregisterConn(c)
+
+	pkt := make([]byte, *packetsize)
+	var expected uint64
+	for {
+		n, err := c.Read(pkt)
+		if err != nil {
+			logger.Error("failed reading packet from conn", "remote_addr", c.RemoteAddr(), "err", err)
+			c.Close()
+			return err
+		}
+		stats.addIn(n)
+		atomic.AddInt64(&packetsReceived, 1)
+		if n < 8 {
+			continue
+		}
+		seq := binary.BigEndian.Uint64(pkt[:8])
+		if seq > expected {
+			atomic.AddInt64(&packetsLost, int64(seq-expected))
+		}
+		expected = seq + 1
+	}
+	return nil
+}